@@ -3,11 +3,54 @@ package http
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/metrics"
 )
 
+// StatusError is returned by FetchJSON when the response status is outside
+// the 2xx range. It carries the status code and, when present, the
+// Retry-After delay so that callers can make rate-limit-aware retry
+// decisions instead of matching on the error string.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	RetryAfter time.Duration // NOTE: zero if the response didn't send Retry-After.
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf(
+		"failed to %s %s (%d)",
+		err.Method,
+		err.URL,
+		err.StatusCode,
+	)
+}
+
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+
+	return 0
+}
+
 func FetchJSON[T any](req *http.Request, result *T) error {
-	fmt.Printf("FETCH %s %s\n", req.Method, req.URL.String())
+	start := time.Now()
+	slog.Info("fetch", "method", req.Method, "url", req.URL.String())
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -15,13 +58,15 @@ func FetchJSON[T any](req *http.Request, result *T) error {
 	}
 	defer resp.Body.Close()
 
+	metrics.ObserveNPMRequest(req.URL.Path, resp.StatusCode, time.Since(start))
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf(
-			"failed to %s %s (%d)",
-			req.Method,
-			req.URL.String(),
-			resp.StatusCode,
-		)
+		return &StatusError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header),
+		}
 	}
 
 	decoder := json.NewDecoder(resp.Body)
@@ -0,0 +1,115 @@
+// Package metrics exposes a Prometheus /metrics endpoint for the
+// fetch/insert pipeline. It's opt-in: callers only need to call Serve if
+// --metrics-addr was set, and every recording function is safe to call
+// unconditionally otherwise (the registry just accumulates unread samples).
+package metrics
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	npmRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "npm_requests_total",
+		Help: "npm API requests by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+
+	fetchLatencySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "npm_fetch_latency_seconds",
+		Help:    "npm API request latency by endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	batchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fetch_batch_size",
+		Help:    "Number of packages per download-range batch.",
+		Buckets: prometheus.LinearBuckets(1, 16, 8),
+	})
+
+	insertLatencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "insert_latency_seconds",
+		Help:    "Latency of a single batch insert into storage.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	rowsUpsertedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rows_upserted_total",
+		Help: "Daily download rows upserted into storage.",
+	})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_depth",
+		Help: "Outstanding work items per pipeline queue.",
+	}, []string{"queue"})
+
+	failuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "failures_total",
+		Help: "Failures by pipeline stage.",
+	}, []string{"stage"})
+)
+
+func init() {
+	registry.MustRegister(
+		npmRequestsTotal,
+		fetchLatencySeconds,
+		batchSize,
+		insertLatencySeconds,
+		rowsUpsertedTotal,
+		queueDepth,
+		failuresTotal,
+	)
+}
+
+// Serve starts the /metrics HTTP endpoint on addr in the background. It
+// never blocks the caller; a failure to bind is logged rather than
+// returned, since metrics are observability, not a pipeline dependency.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+
+	slog.Info("metrics listening", "addr", addr)
+}
+
+// ObserveNPMRequest records one npm API call against endpoint (the request
+// path, not the full URL, to keep cardinality bounded).
+func ObserveNPMRequest(endpoint string, status int, elapsed time.Duration) {
+	npmRequestsTotal.WithLabelValues(endpoint, fmt.Sprintf("%d", status)).Inc()
+	fetchLatencySeconds.WithLabelValues(endpoint).Observe(elapsed.Seconds())
+}
+
+// ObserveBatch records the size of a download-range batch.
+func ObserveBatch(size int) {
+	batchSize.Observe(float64(size))
+}
+
+// ObserveInsert records one batch insert: how long it took and how many
+// rows it upserted.
+func ObserveInsert(elapsed time.Duration, rows int) {
+	insertLatencySeconds.Observe(elapsed.Seconds())
+	rowsUpsertedTotal.Add(float64(rows))
+}
+
+// SetQueueDepth reports the current depth of a named pipeline queue
+// (search, fetch, insert).
+func SetQueueDepth(queue string, depth int) {
+	queueDepth.WithLabelValues(queue).Set(float64(depth))
+}
+
+// IncFailure counts one failure at stage (search, fetch, insert).
+func IncFailure(stage string) {
+	failuresTotal.WithLabelValues(stage).Inc()
+}
@@ -3,12 +3,15 @@ package npm
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/make-github-pseudonymous-again/npm-downloads/internals/arrays"
 	_http "github.com/make-github-pseudonymous-again/npm-downloads/internals/http"
-	"github.com/make-github-pseudonymous-again/npm-downloads/internals/npm/names"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/metrics"
 )
 
 const (
@@ -17,6 +20,10 @@ const (
 	MaxBatchSize                     = 128
 )
 
+// nextBatchID hands out a process-unique id for each Batch PackageDownloadBatches
+// creates, so log lines across retries of the same batch can be correlated.
+var nextBatchID atomic.Int64
+
 type DailyDownload struct {
 	Downloads int    `json:"downloads"`
 	Day       string `json:"day"`
@@ -33,6 +40,7 @@ type SinglePackageResponse struct {
 type MultiPackageResponse map[string]SinglePackageResponse
 
 type Batch struct {
+	ID       string
 	Period   string
 	Packages []string
 }
@@ -55,12 +63,16 @@ func _batch_req(batch Batch) *http.Request {
 	return req
 }
 
-func FetchBatch(results chan<- SinglePackageResponse, errors chan<- error, batch Batch) {
+func FetchBatch(results chan<- SinglePackageResponse, errors chan<- error, batch Batch, attempt int) {
+	slog.Info("fetch batch", "batch_id", batch.ID, "period", batch.Period, "packages", len(batch.Packages), "attempt", attempt)
+	metrics.ObserveBatch(len(batch.Packages))
+
 	if len(batch.Packages) == 1 {
 		FetchBatchSingle(
 			results,
 			errors,
 			batch,
+			attempt,
 		)
 	}
 
@@ -69,11 +81,12 @@ func FetchBatch(results chan<- SinglePackageResponse, errors chan<- error, batch
 			results,
 			errors,
 			batch,
+			attempt,
 		)
 	}
 }
 
-func FetchBatchSingle(results chan<- SinglePackageResponse, errors chan<- error, batch Batch) {
+func FetchBatchSingle(results chan<- SinglePackageResponse, errors chan<- error, batch Batch, attempt int) {
 	if len(batch.Packages) != 1 {
 		panic("FetchBatchSingle can only handles batches of size == 1")
 	}
@@ -82,6 +95,7 @@ func FetchBatchSingle(results chan<- SinglePackageResponse, errors chan<- error,
 	err := _http.FetchJSON(_batch_req(batch), &response)
 
 	if err != nil {
+		slog.Warn("fetch batch failed", "batch_id", batch.ID, "package", batch.Packages[0], "attempt", attempt, "error", err)
 		errors <- err
 		return
 	}
@@ -93,7 +107,7 @@ func FetchBatchSingle(results chan<- SinglePackageResponse, errors chan<- error,
 	}
 }
 
-func FetchBatchMany(results chan<- SinglePackageResponse, errors chan<- error, batch Batch) {
+func FetchBatchMany(results chan<- SinglePackageResponse, errors chan<- error, batch Batch, attempt int) {
 	if len(batch.Packages) < 2 {
 		panic("FetchBatchMany can only handles batches of size >= 1")
 	}
@@ -102,6 +116,7 @@ func FetchBatchMany(results chan<- SinglePackageResponse, errors chan<- error, b
 	err := _http.FetchJSON(_batch_req(batch), &responses)
 
 	if err != nil {
+		slog.Warn("fetch batch failed", "batch_id", batch.ID, "packages", len(batch.Packages), "attempt", attempt, "error", err)
 		errors <- err
 		return
 	}
@@ -121,7 +136,7 @@ func PackageDownloadBatches(period string, packageNames []string) []Batch {
 	var nonScopedPackages []string
 
 	for _, pkg := range packageNames {
-		if names.IsScopedPackageName(pkg) {
+		if IsScopedPackageName(pkg) {
 			scopedPackages = append(scopedPackages, pkg)
 		} else {
 			nonScopedPackages = append(nonScopedPackages, pkg)
@@ -136,6 +151,7 @@ func PackageDownloadBatches(period string, packageNames []string) []Batch {
 
 	for _, packages := range nonScopedBatches {
 		batch := Batch{
+			ID:       nextID(),
 			Period:   period,
 			Packages: packages,
 		}
@@ -146,6 +162,7 @@ func PackageDownloadBatches(period string, packageNames []string) []Batch {
 	for _, pkg := range scopedPackages {
 		packages := []string{pkg}
 		batch := Batch{
+			ID:       nextID(),
 			Period:   period,
 			Packages: packages,
 		}
@@ -154,3 +171,7 @@ func PackageDownloadBatches(period string, packageNames []string) []Batch {
 
 	return batches
 }
+
+func nextID() string {
+	return strconv.FormatInt(nextBatchID.Add(1), 10)
+}
@@ -0,0 +1,72 @@
+package npm
+
+import "testing"
+
+func TestPackageDownloadBatchesSeparatesScopedPackages(t *testing.T) {
+	cases := []struct {
+		name         string
+		packageNames []string
+		wantBatches  [][]string
+	}{
+		{
+			name:         "no packages",
+			packageNames: nil,
+			wantBatches:  nil,
+		},
+		{
+			name:         "only non-scoped packages fit in one batch",
+			packageNames: []string{"react", "lodash", "express"},
+			wantBatches:  [][]string{{"react", "lodash", "express"}},
+		},
+		{
+			name:         "a scoped package always gets its own batch",
+			packageNames: []string{"react", "@babel/core", "lodash"},
+			wantBatches:  [][]string{{"react", "lodash"}, {"@babel/core"}},
+		},
+		{
+			name:         "only scoped packages, each in its own batch",
+			packageNames: []string{"@babel/core", "@babel/cli"},
+			wantBatches:  [][]string{{"@babel/core"}, {"@babel/cli"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batches := PackageDownloadBatches("last-week", c.packageNames)
+
+			if len(batches) != len(c.wantBatches) {
+				t.Fatalf("len(batches) = %d, want %d", len(batches), len(c.wantBatches))
+			}
+
+			for i, batch := range batches {
+				if len(batch.Packages) != len(c.wantBatches[i]) {
+					t.Fatalf("batches[%d].Packages = %v, want %v", i, batch.Packages, c.wantBatches[i])
+				}
+				for j, pkg := range batch.Packages {
+					if pkg != c.wantBatches[i][j] {
+						t.Errorf("batches[%d].Packages[%d] = %q, want %q", i, j, pkg, c.wantBatches[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPackageDownloadBatchesChunksNonScopedPackages(t *testing.T) {
+	packageNames := make([]string, MaxBatchSize+1)
+	for i := range packageNames {
+		packageNames[i] = "pkg"
+	}
+
+	batches := PackageDownloadBatches("last-week", packageNames)
+
+	if len(batches) != 2 {
+		t.Fatalf("len(batches) = %d, want 2 (MaxBatchSize+1 packages split across two batches)", len(batches))
+	}
+	if len(batches[0].Packages) != MaxBatchSize {
+		t.Errorf("len(batches[0].Packages) = %d, want %d", len(batches[0].Packages), MaxBatchSize)
+	}
+	if len(batches[1].Packages) != 1 {
+		t.Errorf("len(batches[1].Packages) = %d, want 1", len(batches[1].Packages))
+	}
+}
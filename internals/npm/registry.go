@@ -3,6 +3,7 @@ package npm
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 
@@ -110,17 +111,17 @@ func Search(
 		err := _http.FetchJSON(req, &response)
 		if err != nil {
 			errors <- err
-			log.Printf("%v\n", err)
+			slog.Warn("search failed", "query", text, "offset", offset, "error", err)
 			return
 		}
 
 		for _, object := range response.Objects {
-			log.Printf("%v\n", object.Package.Name)
+			slog.Info("search result", "query", text, "package", object.Package.Name)
 			results <- object
 		}
 
 		if len(response.Objects) < step {
-			log.Printf("BREAK\n")
+			slog.Info("search done", "query", text, "offset", offset)
 			break
 		}
 
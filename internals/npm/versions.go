@@ -0,0 +1,90 @@
+package npm
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	_http "github.com/make-github-pseudonymous-again/npm-downloads/internals/http"
+)
+
+const (
+	// NPM_VERSIONS_API_ENDPOINT is single-package-only and, per the npm
+	// registry docs, only supports the "last-week" period.
+	NPM_VERSIONS_API_ENDPOINT = "%s/versions/%s/%s"
+)
+
+type VersionDownload struct {
+	Version   string
+	Downloads int
+}
+
+type versionsResponse struct {
+	Package   string         `json:"package"`
+	Downloads map[string]int `json:"downloads"`
+}
+
+type PackageVersionDownloads struct {
+	Package  string
+	Period   string
+	Versions []VersionDownload
+}
+
+func _versions_url(pkg string, period string) string {
+	return fmt.Sprintf(
+		NPM_VERSIONS_API_ENDPOINT,
+		NPM_DOWNLOADS_API,
+		url.PathEscape(pkg), // NOTE: escapes the "/" in scoped package names.
+		period,
+	)
+}
+
+func _versions_req(pkg string, period string) *http.Request {
+	req, err := http.NewRequest("GET", _versions_url(pkg, period), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return req
+}
+
+// FetchVersionDownloads fetches per-version download counts for a single
+// package over period (only "last-week" is supported by the endpoint).
+func FetchVersionDownloads(results chan<- PackageVersionDownloads, errors chan<- error, pkg string, period string) {
+	var response versionsResponse
+	err := _http.FetchJSON(_versions_req(pkg, period), &response)
+	if err != nil {
+		slog.Warn("fetch version downloads failed", "package", pkg, "period", period, "error", err)
+		errors <- err
+		return
+	}
+
+	versions := make([]VersionDownload, 0, len(response.Downloads))
+	for version, count := range response.Downloads {
+		versions = append(versions, VersionDownload{Version: version, Downloads: count})
+	}
+
+	results <- PackageVersionDownloads{
+		Package:  response.Package,
+		Period:   period,
+		Versions: versions,
+	}
+}
+
+// VersionDownloadBatches plans one batch per package: unlike
+// PackageDownloadBatches, the per-version endpoint takes a single package
+// per request, so there's no MaxBatchSize to group against.
+func VersionDownloadBatches(period string, packageNames []string) []Batch {
+	var batches []Batch
+
+	for _, pkg := range packageNames {
+		batches = append(batches, Batch{
+			ID:       nextID(),
+			Period:   period,
+			Packages: []string{pkg},
+		})
+	}
+
+	return batches
+}
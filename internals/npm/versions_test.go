@@ -0,0 +1,47 @@
+package npm
+
+import "testing"
+
+func TestVersionDownloadBatchesOnePackagePerBatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		packages []string
+	}{
+		{
+			name:     "no packages",
+			packages: nil,
+		},
+		{
+			name:     "single package",
+			packages: []string{"react"},
+		},
+		{
+			name:     "several packages, including a scoped one",
+			packages: []string{"react", "@babel/core", "lodash"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batches := VersionDownloadBatches("last-week", c.packages)
+
+			if len(batches) != len(c.packages) {
+				t.Fatalf("len(batches) = %d, want %d (one batch per package)", len(batches), len(c.packages))
+			}
+
+			seenIDs := make(map[string]bool)
+			for i, batch := range batches {
+				if len(batch.Packages) != 1 || batch.Packages[0] != c.packages[i] {
+					t.Errorf("batches[%d].Packages = %v, want [%q]", i, batch.Packages, c.packages[i])
+				}
+				if batch.Period != "last-week" {
+					t.Errorf("batches[%d].Period = %q, want last-week", i, batch.Period)
+				}
+				if batch.ID == "" || seenIDs[batch.ID] {
+					t.Errorf("batches[%d].ID = %q, want a non-empty, unique id", i, batch.ID)
+				}
+				seenIDs[batch.ID] = true
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Package scheduler sizes worker concurrency from live signals instead of
+// a fixed flag: it grows AIMD-style while outstanding memory, API health
+// and downstream throughput stay healthy, and shrinks the moment any of
+// them isn't.
+package scheduler
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Config bounds the AIMD-style concurrency governor: it starts at Min and
+// grows by one whenever the recent window of outcomes is healthy, halving
+// back down (never below Min) the moment a rate limit is observed or
+// downstream throughput falls behind. The memory budget does not change the
+// limit: Acquire holds back new work while admitting it would exceed
+// MemoryCapBytes.
+type Config struct {
+	Min            int
+	Max            int
+	MemoryCapBytes int64 // NOTE: 0 disables the memory check (e.g. for small search responses).
+}
+
+// Outcome reports how a unit of work scheduled through Acquire went, so
+// Release can feed it into the health window.
+type Outcome struct {
+	Latency     time.Duration
+	RateLimited bool // NOTE: set on 429/5xx, or anything else worth backing off for.
+}
+
+// Scheduler hands out worker slots to callers that would otherwise share a
+// fixed-size chan struct{} semaphore, but sizes the number of slots from
+// live signals rather than a hard-coded --queue value.
+type Scheduler struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	cfg   Config
+	limit float64
+
+	inFlight       int
+	memoryInFlight int64
+
+	window *slidingWindow
+
+	insertBaseline float64 // NOTE: EWMA of rows/sec upserted; see ReportInsertThroughput.
+}
+
+func New(cfg Config) *Scheduler {
+	if cfg.Min < 1 {
+		cfg.Min = 1
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+
+	s := &Scheduler{
+		cfg:    cfg,
+		limit:  float64(cfg.Min),
+		window: newSlidingWindow(),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Acquire blocks until a worker slot (and, if cfg.MemoryCapBytes is set,
+// enough memory budget for estimatedBytes) is available, or ctx is
+// canceled first, in which case it returns false.
+func (s *Scheduler) Acquire(ctx context.Context, estimatedBytes int64) bool {
+	if ctx.Done() != nil {
+		stop := context.AfterFunc(ctx, func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+		defer stop()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.fits(estimatedBytes) {
+		if ctx.Err() != nil {
+			return false
+		}
+		s.cond.Wait()
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	s.inFlight++
+	s.memoryInFlight += estimatedBytes
+	return true
+}
+
+func (s *Scheduler) fits(estimatedBytes int64) bool {
+	if s.inFlight >= int(s.limit) {
+		return false
+	}
+	if s.inFlight == 0 {
+		// NOTE: always admit a solo item, even one whose own estimate
+		// exceeds cfg.MemoryCapBytes. Otherwise an oversized single batch
+		// (e.g. a long --resume window) would never fit and, with nothing
+		// else in flight, no future Release would ever come along to
+		// re-evaluate the condition — Acquire would block forever.
+		return true
+	}
+	if s.cfg.MemoryCapBytes > 0 && s.memoryInFlight+estimatedBytes > s.cfg.MemoryCapBytes {
+		return false
+	}
+	return true
+}
+
+// InFlight returns the number of worker slots currently acquired, for
+// callers that want to expose it (e.g. as a queue-depth metric).
+func (s *Scheduler) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.inFlight
+}
+
+// Release returns the worker slot and memory budget acquired for
+// estimatedBytes, and folds outcome into the AIMD adjustment.
+func (s *Scheduler) Release(estimatedBytes int64, outcome Outcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight--
+	s.memoryInFlight -= estimatedBytes
+	s.window.record(outcome)
+	s.adjust(outcome.RateLimited)
+	s.cond.Broadcast()
+}
+
+// ReportInsertThroughput feeds the observed SQLite insert rate (rows per
+// second) into the scheduler as an additional health signal: concurrency
+// is throttled back if inserts fall well behind the rate established so
+// far, since growing the fetch window further would only pile up results
+// the insert side can't keep up with.
+func (s *Scheduler) ReportInsertThroughput(rowsPerSecond float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	const ewmaAlpha = 0.2
+
+	if s.insertBaseline == 0 {
+		s.insertBaseline = rowsPerSecond
+		return
+	}
+
+	if rowsPerSecond < s.insertBaseline*0.5 {
+		s.limit = math.Max(float64(s.cfg.Min), s.limit/2) // NOTE: AIMD multiplicative decrease.
+	}
+
+	s.insertBaseline = ewmaAlpha*rowsPerSecond + (1-ewmaAlpha)*s.insertBaseline
+}
+
+// adjust applies the AIMD step for the outcome just recorded. The decrease
+// fires only off rateLimited (the sample just released), not
+// s.window.healthy's window-wide history: that history still decides when
+// to grow back, so one rate-limited sample costs one halving, not one
+// halving per Release until it ages out of the window 20 calls later.
+func (s *Scheduler) adjust(rateLimited bool) {
+	if rateLimited {
+		s.limit = math.Max(float64(s.cfg.Min), s.limit/2) // NOTE: AIMD multiplicative decrease.
+		return
+	}
+	if s.window.healthy() {
+		s.limit = math.Min(float64(s.cfg.Max), s.limit+1) // NOTE: AIMD additive increase.
+	}
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// drive feeds n outcomes through Acquire/Release and returns the scheduler's
+// limit afterwards, as an int for easy comparison.
+func drive(s *Scheduler, n int, outcome Outcome) int {
+	for i := 0; i < n; i++ {
+		s.Acquire(context.Background(), 0)
+		s.Release(0, outcome)
+	}
+	return int(s.limit)
+}
+
+func TestAdjustGrowsOnAFullHealthyWindow(t *testing.T) {
+	s := New(Config{Min: 1, Max: 8})
+
+	if got := drive(s, windowSize-1, Outcome{}); got != 1 {
+		t.Fatalf("limit after %d healthy outcomes = %d, want 1 (not yet a full window)", windowSize-1, got)
+	}
+	if got := drive(s, 1, Outcome{}); got != 2 {
+		t.Fatalf("limit after a full healthy window = %d, want 2", got)
+	}
+}
+
+func TestAdjustHalvesOnRateLimit(t *testing.T) {
+	s := New(Config{Min: 1, Max: 8})
+	s.limit = 8
+
+	s.Acquire(context.Background(), 0)
+	s.Release(0, Outcome{RateLimited: true})
+
+	if s.limit != 4 {
+		t.Fatalf("limit after a rate-limited outcome = %v, want 4", s.limit)
+	}
+}
+
+func TestAdjustNeverDropsBelowMin(t *testing.T) {
+	s := New(Config{Min: 2, Max: 8})
+	s.limit = 2
+
+	s.Acquire(context.Background(), 0)
+	s.Release(0, Outcome{RateLimited: true})
+
+	if s.limit != 2 {
+		t.Fatalf("limit after rate-limiting at Min = %v, want 2 (Min)", s.limit)
+	}
+}
+
+func TestAdjustNeverGrowsAboveMax(t *testing.T) {
+	s := New(Config{Min: 1, Max: 2})
+	s.limit = 2
+
+	drive(s, windowSize, Outcome{})
+
+	if s.limit != 2 {
+		t.Fatalf("limit after healthy windows at Max = %v, want 2 (Max)", s.limit)
+	}
+}
+
+func TestAdjustOnlyHalvesOnceForASingleRateLimitEvent(t *testing.T) {
+	s := New(Config{Min: 1, Max: 64})
+	s.limit = 64
+
+	s.Acquire(context.Background(), 0)
+	s.Release(0, Outcome{RateLimited: true})
+	if s.limit != 32 {
+		t.Fatalf("limit after the rate-limited outcome = %v, want 32", s.limit)
+	}
+
+	for i := 0; i < 5; i++ {
+		s.Acquire(context.Background(), 0)
+		s.Release(0, Outcome{})
+		if s.limit != 32 {
+			t.Fatalf(
+				"limit after %d subsequent healthy releases = %v, want 32 (unchanged: a full healthy window hasn't passed yet)",
+				i+1, s.limit,
+			)
+		}
+	}
+}
+
+func TestAcquireAdmitsAnOversizedSoloItem(t *testing.T) {
+	s := New(Config{Min: 1, Max: 1, MemoryCapBytes: 100})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if !s.Acquire(ctx, 1000) {
+		t.Fatal("Acquire(ctx, 1000) against a 100-byte cap with nothing in flight = false, want true (admit-solo)")
+	}
+}
+
+func TestInFlightTracksAcquireRelease(t *testing.T) {
+	s := New(Config{Min: 1, Max: 1})
+
+	s.Acquire(context.Background(), 0)
+	if got := s.InFlight(); got != 1 {
+		t.Fatalf("InFlight() after Acquire = %d, want 1", got)
+	}
+
+	s.Release(0, Outcome{})
+	if got := s.InFlight(); got != 0 {
+		t.Fatalf("InFlight() after Release = %d, want 0", got)
+	}
+}
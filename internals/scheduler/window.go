@@ -0,0 +1,42 @@
+package scheduler
+
+const windowSize = 20
+
+type sample struct {
+	rateLimited bool
+}
+
+// slidingWindow keeps the last windowSize outcomes so the scheduler can
+// judge "has this pool been healthy lately" without unbounded memory.
+type slidingWindow struct {
+	samples [windowSize]sample
+	next    int
+	count   int
+}
+
+func newSlidingWindow() *slidingWindow {
+	return &slidingWindow{}
+}
+
+func (w *slidingWindow) record(outcome Outcome) {
+	w.samples[w.next] = sample{rateLimited: outcome.RateLimited}
+	w.next = (w.next + 1) % windowSize
+	if w.count < windowSize {
+		w.count++
+	}
+}
+
+func (w *slidingWindow) rateLimited() bool {
+	for i := 0; i < w.count; i++ {
+		if w.samples[i].rateLimited {
+			return true
+		}
+	}
+	return false
+}
+
+// healthy requires a full window free of rate limiting before growing
+// concurrency further, so a single good response doesn't cause overshoot.
+func (w *slidingWindow) healthy() bool {
+	return w.count >= windowSize && !w.rateLimited()
+}
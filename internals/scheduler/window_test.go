@@ -0,0 +1,74 @@
+package scheduler
+
+import "testing"
+
+func TestSlidingWindowHealthy(t *testing.T) {
+	cases := []struct {
+		name     string
+		outcomes []Outcome
+		healthy  bool
+	}{
+		{
+			name:     "empty window is not healthy",
+			outcomes: nil,
+			healthy:  false,
+		},
+		{
+			name:     "fewer than windowSize samples is not healthy",
+			outcomes: repeat(Outcome{}, windowSize-1),
+			healthy:  false,
+		},
+		{
+			name:     "full window with no rate limiting is healthy",
+			outcomes: repeat(Outcome{}, windowSize),
+			healthy:  true,
+		},
+		{
+			name:     "a single rate-limited sample in a full window is not healthy",
+			outcomes: append(repeat(Outcome{}, windowSize-1), Outcome{RateLimited: true}),
+			healthy:  false,
+		},
+		{
+			name: "a rate-limited sample evicted by newer samples is healthy again",
+			// NOTE: one rate-limited sample followed by windowSize healthy
+			// ones should fully cycle it out of the window.
+			outcomes: append([]Outcome{{RateLimited: true}}, repeat(Outcome{}, windowSize)...),
+			healthy:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := newSlidingWindow()
+			for _, o := range c.outcomes {
+				w.record(o)
+			}
+			if got := w.healthy(); got != c.healthy {
+				t.Errorf("healthy() = %v, want %v", got, c.healthy)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowRateLimited(t *testing.T) {
+	w := newSlidingWindow()
+	for i := 0; i < windowSize; i++ {
+		w.record(Outcome{})
+	}
+	if w.rateLimited() {
+		t.Fatal("rateLimited() = true on an all-healthy window")
+	}
+
+	w.record(Outcome{RateLimited: true})
+	if !w.rateLimited() {
+		t.Fatal("rateLimited() = false right after recording a rate-limited outcome")
+	}
+}
+
+func repeat(o Outcome, n int) []Outcome {
+	outcomes := make([]Outcome, n)
+	for i := range outcomes {
+		outcomes[i] = o
+	}
+	return outcomes
+}
@@ -0,0 +1,67 @@
+// Package storage defines the pluggable persistence interface the rest of
+// the pipeline programs against, so dialect-specific SQL (placeholder
+// syntax, upsert strategy, bulk-insert mechanism) stays behind a single
+// driver implementation instead of leaking into main.
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// DailyDownload is one package-day download count, decoupled from the npm
+// API response shape so backends don't need to import internals/npm.
+type DailyDownload struct {
+	Day       string
+	Downloads int
+}
+
+// Cursor tracks incremental sync progress for a single package; see
+// internals/sync for how it drives --resume.
+type Cursor struct {
+	Package             string
+	LastSuccessfulDay   string
+	LastAttemptAt       time.Time
+	NextRetryAt         time.Time
+	ConsecutiveFailures int
+}
+
+// VersionDownload is one version's download count for a package over a
+// single period (the npm per-version endpoint only reports "last-week").
+type VersionDownload struct {
+	Version   string
+	Downloads int
+}
+
+// Backend persists download counts and sync cursors for one storage
+// engine. Selected at startup via --storage=<scheme>://...; see the
+// sqlite and postgres subpackages for the available schemes.
+type Backend interface {
+	// UpsertDownloads records downloads for pkg, keeping the higher count
+	// on conflict and stamping observedAt as when they were fetched.
+	UpsertDownloads(ctx context.Context, pkg string, downloads []DailyDownload, observedAt time.Time) error
+
+	// GetCursor returns the sync cursor for pkg, and false if none has
+	// been recorded yet.
+	GetCursor(ctx context.Context, pkg string) (Cursor, bool, error)
+
+	// SetCursor persists cursor, creating or overwriting the row for its
+	// package.
+	SetCursor(ctx context.Context, cursor Cursor) error
+
+	// QueryRange returns the stored daily downloads for pkg between from
+	// and to (inclusive, "YYYY-MM-DD"), ordered by day.
+	QueryRange(ctx context.Context, pkg string, from string, to string) ([]DailyDownload, error)
+
+	// UpsertVersionDownloads records per-version downloads for pkg over the
+	// period ending periodEnd ("YYYY-MM-DD"), keyed by (pkg, version,
+	// periodEnd), keeping the higher count on conflict.
+	UpsertVersionDownloads(ctx context.Context, pkg string, periodEnd string, downloads []VersionDownload, observedAt time.Time) error
+
+	// MaxConcurrentWrites bounds how many UpsertDownloads calls may safely
+	// run at once against this backend (e.g. 1 for SQLite, which only
+	// supports a single writer).
+	MaxConcurrentWrites() int
+
+	Close() error
+}
@@ -0,0 +1,327 @@
+// Package postgres is the Postgres storage.Backend, selected via
+// --storage=postgres://... It has no single-writer constraint like SQLite,
+// so UpsertDownloads can run with real concurrency, bulk-loading through a
+// COPY-staged upsert rather than a single large multi-row INSERT.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/storage"
+)
+
+const (
+	DateFormat = "2006-01-02"
+
+	DownloadsTable = `
+	CREATE TABLE IF NOT EXISTS downloads (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		date DATE NOT NULL,
+		last_updated_at TIMESTAMPTZ NOT NULL,
+
+		date_year INTEGER NOT NULL,
+		date_month INTEGER NOT NULL,
+		date_day INTEGER NOT NULL,
+		date_day_of_week INTEGER NOT NULL,
+
+		UNIQUE(name, date_year, date_month, date_day)
+	);
+	`
+
+	SyncStateTable = `
+	CREATE TABLE IF NOT EXISTS sync_state (
+		name TEXT PRIMARY KEY,
+		last_successful_day TEXT,
+		last_attempt_at TIMESTAMPTZ,
+		next_retry_at TIMESTAMPTZ,
+		consecutive_failures INTEGER NOT NULL DEFAULT 0
+	);
+	`
+
+	StagingTable = `
+	CREATE TEMPORARY TABLE IF NOT EXISTS downloads_staging (
+		name TEXT, count INTEGER, date DATE, last_updated_at TIMESTAMPTZ,
+		date_year INTEGER, date_month INTEGER, date_day INTEGER, date_day_of_week INTEGER
+	) ON COMMIT DROP;
+	`
+
+	UpsertFromStagingQuery = `
+	INSERT INTO downloads (
+		name, count, date, last_updated_at,
+		date_year, date_month, date_day, date_day_of_week
+	)
+	SELECT DISTINCT ON (name, date_year, date_month, date_day)
+		name, count, date, last_updated_at,
+		date_year, date_month, date_day, date_day_of_week
+	FROM downloads_staging
+	ORDER BY name, date_year, date_month, date_day, count DESC
+	ON CONFLICT (name, date_year, date_month, date_day)
+	DO UPDATE SET
+		count=excluded.count,
+		last_updated_at=excluded.last_updated_at
+	WHERE excluded.count > downloads.count;
+	`
+
+	VersionDownloadsTable = `
+	CREATE TABLE IF NOT EXISTS version_downloads (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		version TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		period_end DATE NOT NULL,
+		last_updated_at TIMESTAMPTZ NOT NULL,
+
+		UNIQUE(name, version, period_end)
+	);
+	`
+
+	VersionDownloadsStagingTable = `
+	CREATE TEMPORARY TABLE IF NOT EXISTS version_downloads_staging (
+		name TEXT, version TEXT, count INTEGER, period_end DATE, last_updated_at TIMESTAMPTZ
+	) ON COMMIT DROP;
+	`
+
+	UpsertVersionDownloadsFromStagingQuery = `
+	INSERT INTO version_downloads (
+		name, version, count, period_end, last_updated_at
+	)
+	SELECT DISTINCT ON (name, version, period_end)
+		name, version, count, period_end, last_updated_at
+	FROM version_downloads_staging
+	ORDER BY name, version, period_end, count DESC
+	ON CONFLICT (name, version, period_end)
+	DO UPDATE SET
+		count=excluded.count,
+		last_updated_at=excluded.last_updated_at
+	WHERE excluded.count > version_downloads.count;
+	`
+
+	SelectCursorQuery = `
+	SELECT last_successful_day, last_attempt_at, next_retry_at, consecutive_failures
+	FROM sync_state
+	WHERE name = $1;
+	`
+
+	UpsertCursorQuery = `
+	INSERT INTO sync_state (
+		name, last_successful_day, last_attempt_at, next_retry_at, consecutive_failures
+	) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (name)
+	DO UPDATE SET
+		last_successful_day=excluded.last_successful_day,
+		last_attempt_at=excluded.last_attempt_at,
+		next_retry_at=excluded.next_retry_at,
+		consecutive_failures=excluded.consecutive_failures;
+	`
+
+	SelectRangeQuery = `
+	SELECT to_char(date, 'YYYY-MM-DD'), count
+	FROM downloads
+	WHERE name = $1 AND date >= $2 AND date <= $3
+	ORDER BY date;
+	`
+
+	// maxConcurrentWrites bounds concurrent UpsertDownloads calls. Postgres
+	// has no single-writer constraint like SQLite; this is sized for
+	// reasonable connection-pool usage rather than correctness.
+	maxConcurrentWrites = 8
+)
+
+type Backend struct {
+	db *sql.DB
+}
+
+// Open connects to a Postgres database at dsn (a postgres:// URL or
+// keyword/value string, per lib/pq).
+func Open(dsn string) (storage.Backend, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: opening %q: %w", dsn, err)
+	}
+
+	if _, err := db.Exec(DownloadsTable); err != nil {
+		return nil, fmt.Errorf("postgres: creating downloads table: %w", err)
+	}
+	if _, err := db.Exec(SyncStateTable); err != nil {
+		return nil, fmt.Errorf("postgres: creating sync_state table: %w", err)
+	}
+	if _, err := db.Exec(VersionDownloadsTable); err != nil {
+		return nil, fmt.Errorf("postgres: creating version_downloads table: %w", err)
+	}
+
+	return &Backend{db: db}, nil
+}
+
+// UpsertDownloads bulk-loads downloads via COPY into a per-transaction
+// staging table, then upserts from there in one statement.
+func (b *Backend) UpsertDownloads(ctx context.Context, pkg string, downloads []storage.DailyDownload, observedAt time.Time) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("postgres: beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, StagingTable); err != nil {
+		return fmt.Errorf("postgres: creating staging table: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(
+		"downloads_staging",
+		"name", "count", "date", "last_updated_at",
+		"date_year", "date_month", "date_day", "date_day_of_week",
+	))
+	if err != nil {
+		return fmt.Errorf("postgres: preparing COPY: %w", err)
+	}
+
+	for _, point := range downloads {
+		date, err := time.Parse(DateFormat, point.Day)
+		if err != nil {
+			return fmt.Errorf("postgres: parsing date %q: %w", point.Day, err)
+		}
+
+		if _, err := stmt.ExecContext(ctx,
+			pkg, point.Downloads, date, observedAt,
+			date.Year(), int(date.Month()), date.Day(), int(date.Weekday()),
+		); err != nil {
+			return fmt.Errorf("postgres: staging row for %v: %w", pkg, err)
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("postgres: flushing COPY for %v: %w", pkg, err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("postgres: closing COPY for %v: %w", pkg, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, UpsertFromStagingQuery); err != nil {
+		return fmt.Errorf("postgres: upserting downloads for %v: %w", pkg, err)
+	}
+
+	return tx.Commit()
+}
+
+func (b *Backend) UpsertVersionDownloads(ctx context.Context, pkg string, periodEnd string, downloads []storage.VersionDownload, observedAt time.Time) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	end, err := time.Parse(DateFormat, periodEnd)
+	if err != nil {
+		return fmt.Errorf("postgres: parsing period end %q: %w", periodEnd, err)
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("postgres: beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, VersionDownloadsStagingTable); err != nil {
+		return fmt.Errorf("postgres: creating version_downloads staging table: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(
+		"version_downloads_staging",
+		"name", "version", "count", "period_end", "last_updated_at",
+	))
+	if err != nil {
+		return fmt.Errorf("postgres: preparing COPY: %w", err)
+	}
+
+	for _, point := range downloads {
+		if _, err := stmt.ExecContext(ctx, pkg, point.Version, point.Downloads, end, observedAt); err != nil {
+			return fmt.Errorf("postgres: staging version row for %v: %w", pkg, err)
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("postgres: flushing COPY for %v: %w", pkg, err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("postgres: closing COPY for %v: %w", pkg, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, UpsertVersionDownloadsFromStagingQuery); err != nil {
+		return fmt.Errorf("postgres: upserting version downloads for %v: %w", pkg, err)
+	}
+
+	return tx.Commit()
+}
+
+func (b *Backend) GetCursor(ctx context.Context, pkg string) (storage.Cursor, bool, error) {
+	cursor := storage.Cursor{Package: pkg}
+
+	var lastAttemptAt, nextRetryAt sql.NullTime
+	var lastSuccessfulDay sql.NullString
+
+	row := b.db.QueryRowContext(ctx, SelectCursorQuery, pkg)
+	err := row.Scan(&lastSuccessfulDay, &lastAttemptAt, &nextRetryAt, &cursor.ConsecutiveFailures)
+	if err == sql.ErrNoRows {
+		return cursor, false, nil
+	}
+	if err != nil {
+		return cursor, false, fmt.Errorf("postgres: reading cursor for %v: %w", pkg, err)
+	}
+
+	cursor.LastSuccessfulDay = lastSuccessfulDay.String
+	cursor.LastAttemptAt = lastAttemptAt.Time
+	cursor.NextRetryAt = nextRetryAt.Time
+
+	return cursor, true, nil
+}
+
+func (b *Backend) SetCursor(ctx context.Context, cursor storage.Cursor) error {
+	_, err := b.db.ExecContext(
+		ctx,
+		UpsertCursorQuery,
+		cursor.Package,
+		cursor.LastSuccessfulDay,
+		cursor.LastAttemptAt,
+		cursor.NextRetryAt,
+		cursor.ConsecutiveFailures,
+	)
+	if err != nil {
+		return fmt.Errorf("postgres: saving cursor for %v: %w", cursor.Package, err)
+	}
+	return nil
+}
+
+func (b *Backend) QueryRange(ctx context.Context, pkg string, from string, to string) ([]storage.DailyDownload, error) {
+	rows, err := b.db.QueryContext(ctx, SelectRangeQuery, pkg, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: querying range for %v: %w", pkg, err)
+	}
+	defer rows.Close()
+
+	var downloads []storage.DailyDownload
+	for rows.Next() {
+		var point storage.DailyDownload
+		if err := rows.Scan(&point.Day, &point.Downloads); err != nil {
+			return nil, fmt.Errorf("postgres: scanning range row for %v: %w", pkg, err)
+		}
+		downloads = append(downloads, point)
+	}
+
+	return downloads, rows.Err()
+}
+
+func (b *Backend) MaxConcurrentWrites() int {
+	return maxConcurrentWrites
+}
+
+func (b *Backend) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,268 @@
+// Package sqlite is the SQLite storage.Backend, the default used when no
+// --storage flag is given. It has a single writer, so callers must keep
+// concurrent UpsertDownloads calls within MaxConcurrentWrites.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/storage"
+)
+
+const (
+	DateFormat = "2006-01-02"
+
+	DownloadsTable = `
+	CREATE TABLE IF NOT EXISTS downloads (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		date DATETIME NOT NULL,
+    	last_updated_at DATETIME NOT NULL,
+
+		date_year INTEGER NOT NULL,
+		date_month INTEGER NOT NULL,
+		date_day INTEGER NOT NULL,
+		date_day_of_week INTEGER NOT NULL,
+
+		UNIQUE(name, date_year, date_month, date_day)
+	);
+	`
+
+	SyncStateTable = `
+	CREATE TABLE IF NOT EXISTS sync_state (
+		name TEXT PRIMARY KEY,
+		last_successful_day TEXT,
+		last_attempt_at DATETIME,
+		next_retry_at DATETIME,
+		consecutive_failures INTEGER NOT NULL DEFAULT 0
+	);
+	`
+
+	DownloadsUpsertTemplate = `
+	INSERT INTO downloads (
+		name, count, date, last_updated_at,
+		date_year, date_month, date_day, date_day_of_week
+	) VALUES %s
+	ON CONFLICT(name, date_year, date_month, date_day)
+	DO UPDATE SET
+		count=excluded.count,
+		last_updated_at=excluded.last_updated_at
+	WHERE
+		excluded.count > downloads.count;
+	`
+
+	VersionDownloadsTable = `
+	CREATE TABLE IF NOT EXISTS version_downloads (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		version TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		period_end TEXT NOT NULL,
+		last_updated_at DATETIME NOT NULL,
+
+		UNIQUE(name, version, period_end)
+	);
+	`
+
+	VersionDownloadsUpsertTemplate = `
+	INSERT INTO version_downloads (
+		name, version, count, period_end, last_updated_at
+	) VALUES %s
+	ON CONFLICT(name, version, period_end)
+	DO UPDATE SET
+		count=excluded.count,
+		last_updated_at=excluded.last_updated_at
+	WHERE
+		excluded.count > version_downloads.count;
+	`
+
+	SelectCursorQuery = `
+	SELECT last_successful_day, last_attempt_at, next_retry_at, consecutive_failures
+	FROM sync_state
+	WHERE name = ?;
+	`
+
+	UpsertCursorQuery = `
+	INSERT INTO sync_state (
+		name, last_successful_day, last_attempt_at, next_retry_at, consecutive_failures
+	) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(name)
+	DO UPDATE SET
+		last_successful_day=excluded.last_successful_day,
+		last_attempt_at=excluded.last_attempt_at,
+		next_retry_at=excluded.next_retry_at,
+		consecutive_failures=excluded.consecutive_failures;
+	`
+
+	SelectRangeQuery = `
+	SELECT printf('%04d-%02d-%02d', date_year, date_month, date_day), count
+	FROM downloads
+	WHERE name = ?
+		AND printf('%04d-%02d-%02d', date_year, date_month, date_day) >= ?
+		AND printf('%04d-%02d-%02d', date_year, date_month, date_day) <= ?
+	ORDER BY date_year, date_month, date_day;
+	`
+
+	// MaxConcurrentWrites is 1: there is no possible concurrency with
+	// sqlite3 and the pre-processing is quite light.
+	maxConcurrentWrites = 1
+)
+
+type Backend struct {
+	db *sql.DB
+}
+
+// Open connects to (and, if needed, creates) a SQLite database at dsn, an
+// empty dsn defaulting to ./storage.sqlite3.
+func Open(dsn string) (storage.Backend, error) {
+	if dsn == "" {
+		dsn = "./storage.sqlite3"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: opening %q: %w", dsn, err)
+	}
+
+	if _, err := db.Exec(DownloadsTable); err != nil {
+		return nil, fmt.Errorf("sqlite: creating downloads table: %w", err)
+	}
+	if _, err := db.Exec(SyncStateTable); err != nil {
+		return nil, fmt.Errorf("sqlite: creating sync_state table: %w", err)
+	}
+	if _, err := db.Exec(VersionDownloadsTable); err != nil {
+		return nil, fmt.Errorf("sqlite: creating version_downloads table: %w", err)
+	}
+
+	return &Backend{db: db}, nil
+}
+
+func (b *Backend) UpsertDownloads(ctx context.Context, pkg string, downloads []storage.DailyDownload, observedAt time.Time) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	var placeholders []string
+	var args []interface{}
+
+	for _, point := range downloads {
+		date, err := time.Parse(DateFormat, point.Day)
+		if err != nil {
+			return fmt.Errorf("sqlite: parsing date %q: %w", point.Day, err)
+		}
+
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args,
+			pkg,
+			point.Downloads,
+			date,
+			observedAt,
+			date.Year(),
+			int(date.Month()),
+			date.Day(),
+			int(date.Weekday()),
+		)
+	}
+
+	query := fmt.Sprintf(DownloadsUpsertTemplate, strings.Join(placeholders, ","))
+
+	if _, err := b.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("sqlite: upserting downloads for %v: %w", pkg, err)
+	}
+
+	return nil
+}
+
+func (b *Backend) UpsertVersionDownloads(ctx context.Context, pkg string, periodEnd string, downloads []storage.VersionDownload, observedAt time.Time) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	var placeholders []string
+	var args []interface{}
+
+	for _, point := range downloads {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		args = append(args, pkg, point.Version, point.Downloads, periodEnd, observedAt)
+	}
+
+	query := fmt.Sprintf(VersionDownloadsUpsertTemplate, strings.Join(placeholders, ","))
+
+	if _, err := b.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("sqlite: upserting version downloads for %v: %w", pkg, err)
+	}
+
+	return nil
+}
+
+func (b *Backend) GetCursor(ctx context.Context, pkg string) (storage.Cursor, bool, error) {
+	cursor := storage.Cursor{Package: pkg}
+
+	var lastAttemptAt, nextRetryAt sql.NullTime
+	var lastSuccessfulDay sql.NullString
+
+	row := b.db.QueryRowContext(ctx, SelectCursorQuery, pkg)
+	err := row.Scan(&lastSuccessfulDay, &lastAttemptAt, &nextRetryAt, &cursor.ConsecutiveFailures)
+	if err == sql.ErrNoRows {
+		return cursor, false, nil
+	}
+	if err != nil {
+		return cursor, false, fmt.Errorf("sqlite: reading cursor for %v: %w", pkg, err)
+	}
+
+	cursor.LastSuccessfulDay = lastSuccessfulDay.String
+	cursor.LastAttemptAt = lastAttemptAt.Time
+	cursor.NextRetryAt = nextRetryAt.Time
+
+	return cursor, true, nil
+}
+
+func (b *Backend) SetCursor(ctx context.Context, cursor storage.Cursor) error {
+	_, err := b.db.ExecContext(
+		ctx,
+		UpsertCursorQuery,
+		cursor.Package,
+		cursor.LastSuccessfulDay,
+		cursor.LastAttemptAt,
+		cursor.NextRetryAt,
+		cursor.ConsecutiveFailures,
+	)
+	if err != nil {
+		return fmt.Errorf("sqlite: saving cursor for %v: %w", cursor.Package, err)
+	}
+	return nil
+}
+
+func (b *Backend) QueryRange(ctx context.Context, pkg string, from string, to string) ([]storage.DailyDownload, error) {
+	rows, err := b.db.QueryContext(ctx, SelectRangeQuery, pkg, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: querying range for %v: %w", pkg, err)
+	}
+	defer rows.Close()
+
+	var downloads []storage.DailyDownload
+	for rows.Next() {
+		var point storage.DailyDownload
+		if err := rows.Scan(&point.Day, &point.Downloads); err != nil {
+			return nil, fmt.Errorf("sqlite: scanning range row for %v: %w", pkg, err)
+		}
+		downloads = append(downloads, point)
+	}
+
+	return downloads, rows.Err()
+}
+
+func (b *Backend) MaxConcurrentWrites() int {
+	return maxConcurrentWrites
+}
+
+func (b *Backend) Close() error {
+	return b.db.Close()
+}
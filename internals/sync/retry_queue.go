@@ -0,0 +1,120 @@
+package sync
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/npm"
+)
+
+type retryItem struct {
+	batch   npm.Batch
+	attempt int
+	at      time.Time
+}
+
+type retryHeap []*retryItem
+
+func (h retryHeap) Len() int           { return len(h) }
+func (h retryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h retryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *retryHeap) Push(x any) { *h = append(*h, x.(*retryItem)) }
+
+func (h *retryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// retryQueue is a priority queue of batches deferred due to rate limiting or
+// transient failures, ordered by the time they become eligible for retry.
+type retryQueue struct {
+	mu    sync.Mutex
+	items retryHeap
+	wake  chan struct{}
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *retryQueue) push(batch npm.Batch, attempt int, at time.Time) {
+	q.mu.Lock()
+	heap.Push(&q.items, &retryItem{batch: batch, attempt: attempt, at: at})
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run calls fire for each deferred batch once it becomes due, until ctx is
+// canceled. On cancellation it fires every still-pending batch immediately
+// instead of waiting out its backoff, so fire (which ends up back at
+// runner.schedule) can observe the canceled ctx and release it from
+// runner.pending right away rather than leaving Run's pending.Wait()
+// hanging on a batch that was never going to fire again.
+func (q *retryQueue) run(ctx context.Context, fire func(npm.Batch, int)) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		wait := time.Hour
+		if len(q.items) > 0 {
+			wait = time.Until(q.items[0].at)
+			if wait < 0 {
+				wait = 0
+			}
+		}
+		q.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			q.drain(fire)
+			return
+		case <-q.wake:
+			continue
+		case <-timer.C:
+			q.mu.Lock()
+			var due []*retryItem
+			for len(q.items) > 0 && !q.items[0].at.After(time.Now()) {
+				due = append(due, heap.Pop(&q.items).(*retryItem))
+			}
+			q.mu.Unlock()
+
+			for _, item := range due {
+				fire(item.batch, item.attempt)
+			}
+		}
+	}
+}
+
+// drain fires every batch still waiting on its backoff, regardless of
+// whether it's actually due yet.
+func (q *retryQueue) drain(fire func(npm.Batch, int)) {
+	q.mu.Lock()
+	var pending []*retryItem
+	for len(q.items) > 0 {
+		pending = append(pending, heap.Pop(&q.items).(*retryItem))
+	}
+	q.mu.Unlock()
+
+	for _, item := range pending {
+		fire(item.batch, item.attempt)
+	}
+}
@@ -0,0 +1,181 @@
+package sync
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/npm"
+)
+
+func TestRetryHeapOrdersByTime(t *testing.T) {
+	base := time.Now()
+
+	cases := []struct {
+		name  string
+		at    []time.Duration // offsets from base, push order
+		order []int           // expected pop order, as indices into at
+	}{
+		{
+			name:  "already sorted",
+			at:    []time.Duration{0, time.Second, 2 * time.Second},
+			order: []int{0, 1, 2},
+		},
+		{
+			name:  "reverse order",
+			at:    []time.Duration{2 * time.Second, time.Second, 0},
+			order: []int{2, 1, 0},
+		},
+		{
+			name:  "single item",
+			at:    []time.Duration{0},
+			order: []int{0},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &retryHeap{}
+			heap.Init(h)
+			for i, d := range c.at {
+				heap.Push(h, &retryItem{attempt: i, at: base.Add(d)})
+			}
+
+			for _, want := range c.order {
+				got := heap.Pop(h).(*retryItem)
+				if got.attempt != want {
+					t.Fatalf("pop order = attempt %d, want attempt %d", got.attempt, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryQueueRunFiresDueItemsInOrder(t *testing.T) {
+	q := newRetryQueue()
+	now := time.Now()
+
+	var mu sync.Mutex
+	var fired []int
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// NOTE: push both before run starts so they are due together; pushed
+	// into a running queue, the first could fire before the second exists.
+	q.push(npm.Batch{}, 2, now.Add(-time.Millisecond))
+	q.push(npm.Batch{}, 1, now.Add(-2*time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		q.run(ctx, func(batch npm.Batch, attempt int) {
+			mu.Lock()
+			fired = append(fired, attempt)
+			mu.Unlock()
+		})
+		close(done)
+	}()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(fired) == 2
+	})
+
+	mu.Lock()
+	if fired[0] != 1 || fired[1] != 2 {
+		t.Fatalf("fired order = %v, want [1 2]", fired)
+	}
+	mu.Unlock()
+
+	cancel()
+	<-done
+}
+
+func TestRetryQueueRunDrainsOnCancellation(t *testing.T) {
+	q := newRetryQueue()
+
+	var mu sync.Mutex
+	var fired []int
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		q.run(ctx, func(batch npm.Batch, attempt int) {
+			mu.Lock()
+			fired = append(fired, attempt)
+			mu.Unlock()
+		})
+		close(done)
+	}()
+
+	// Push items that won't become due on their own for a long time.
+	q.push(npm.Batch{}, 1, time.Now().Add(time.Hour))
+	q.push(npm.Batch{}, 2, time.Now().Add(2*time.Hour))
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not return promptly after cancellation")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fired) != 2 {
+		t.Fatalf("fired = %v, want both deferred items drained on cancellation", fired)
+	}
+}
+
+// TestRetryQueuePushAfterRunReturnsNeverFires documents why callers must not
+// push once ctx is done: run has already returned and nobody is left reading
+// the heap, so a late push sits there forever. runner.schedule guards
+// against this by checking r.ctx.Err() before calling defer_/push.
+func TestRetryQueuePushAfterRunReturnsNeverFires(t *testing.T) {
+	q := newRetryQueue()
+
+	var mu sync.Mutex
+	var fired []int
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		q.run(ctx, func(batch npm.Batch, attempt int) {
+			mu.Lock()
+			fired = append(fired, attempt)
+			mu.Unlock()
+		})
+		close(done)
+	}()
+
+	cancel()
+	<-done
+
+	q.push(npm.Batch{}, 1, time.Now())
+
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fired) != 0 {
+		t.Fatalf("fired = %v, want empty: a push after run() returns should never fire", fired)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("condition not met before deadline")
+}
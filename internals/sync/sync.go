@@ -0,0 +1,352 @@
+// Package sync turns the one-shot download fetch into a resumable,
+// rate-limit-aware incremental sync engine: per-package cursors let a
+// re-run fetch only the missing day-range, and batches that hit a 429/5xx
+// are deferred and retried with backoff instead of being reported as
+// failures straight away.
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_http "github.com/make-github-pseudonymous-again/npm-downloads/internals/http"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/metrics"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/npm"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/scheduler"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/storage"
+)
+
+const (
+	DateFormat = "2006-01-02"
+
+	BaseBackoff = 2 * time.Second
+	MaxBackoff  = 5 * time.Minute
+	MaxAttempts = 8
+
+	// BytesPerDayEntryEstimate approximates the JSON footprint of one
+	// per-package per-day download count. It doesn't need to be exact: the
+	// scheduler only uses it to shed load before memory pressure gets bad.
+	BytesPerDayEntryEstimate = 64
+)
+
+type Config struct {
+	Backend   storage.Backend
+	Period    string
+	Packages  []string
+	Scheduler *scheduler.Scheduler
+	Resume    bool
+}
+
+type Result struct {
+	Failures int
+}
+
+// Run fetches download counts for cfg.Packages, writing successes to
+// results and unretryable errors to errs, until every batch has either
+// succeeded, failed permanently, or ctx is canceled. On cancellation
+// (e.g. SIGINT) it stops scheduling new work and returns once in-flight
+// batches drain; each package's checkpoint is already durable in
+// sync_state by the time its batch succeeds, so the next run with
+// --resume picks up where this one left off.
+func Run(
+	ctx context.Context,
+	cfg Config,
+	results chan<- npm.SinglePackageResponse,
+	errs chan<- error,
+) Result {
+	groups := plan(ctx, cfg.Backend, cfg.Period, cfg.Packages, cfg.Resume)
+
+	var batches []npm.Batch
+	for period, packages := range groups {
+		batches = append(batches, npm.PackageDownloadBatches(period, packages)...)
+	}
+
+	if len(batches) == 0 {
+		fmt.Println("SYNC nothing to do")
+		return Result{}
+	}
+
+	r := &runner{
+		ctx:     ctx,
+		backend: cfg.Backend,
+		sched:   cfg.Scheduler,
+		results: results,
+		errs:    errs,
+		retries: newRetryQueue(),
+	}
+
+	// NOTE: run shares Run's own ctx (not an independent one) so a SIGINT
+	// wakes it immediately instead of waiting out a pending batch's
+	// backoff, which can be up to MaxBackoff.
+	go r.retries.run(ctx, func(batch npm.Batch, attempt int) {
+		r.schedule(batch, attempt)
+	})
+
+	for _, batch := range batches {
+		r.pending.Add(1)
+		r.schedule(batch, 0)
+	}
+
+	r.pending.Wait()
+
+	return Result{Failures: int(atomic.LoadInt32(&r.failures))}
+}
+
+// plan groups packages by the period string that should be fetched for
+// them: the full requested period for a fresh sync, or the day-range since
+// their last checkpoint when resuming. Packages that are already up to date
+// are dropped entirely.
+func plan(ctx context.Context, backend storage.Backend, period string, packages []string, resume bool) map[string][]string {
+	groups := make(map[string][]string)
+
+	for _, pkg := range packages {
+		effective := period
+
+		if resume {
+			cursor, ok, err := backend.GetCursor(ctx, pkg)
+			if err != nil {
+				fmt.Printf("SYNC error reading cursor for %v: %v\n", pkg, err)
+			} else if ok && cursor.LastSuccessfulDay != "" {
+				window, hasWork := resumeWindow(cursor.LastSuccessfulDay)
+				if !hasWork {
+					continue
+				}
+				effective = window
+			}
+		}
+
+		groups[effective] = append(groups[effective], pkg)
+	}
+
+	return groups
+}
+
+// resumeWindow returns the "YYYY-MM-DD:YYYY-MM-DD" period covering the days
+// after lastSuccessfulDay up to now, and false if there is nothing new to
+// fetch.
+func resumeWindow(lastSuccessfulDay string) (string, bool) {
+	last, err := time.Parse(DateFormat, lastSuccessfulDay)
+	if err != nil {
+		return "", false
+	}
+
+	// NOTE: compare calendar days, not instants: last parses as UTC midnight
+	// while today's date comes from the local clock.
+	start := last.AddDate(0, 0, 1).Format(DateFormat)
+	end := time.Now().Format(DateFormat)
+	if start > end { // NOTE: YYYY-MM-DD sorts lexicographically.
+		return "", false
+	}
+
+	return fmt.Sprintf("%s:%s", start, end), true
+}
+
+type runner struct {
+	ctx     context.Context
+	backend storage.Backend
+	sched   *scheduler.Scheduler
+	results chan<- npm.SinglePackageResponse
+	errs    chan<- error
+	retries *retryQueue
+
+	pending  sync.WaitGroup
+	failures int32
+}
+
+func (r *runner) schedule(batch npm.Batch, attempt int) {
+	select {
+	case <-r.ctx.Done():
+		// NOTE: Shutting down: abandon this batch. Its packages' cursors
+		// already record where to resume from on the next --resume run.
+		r.pending.Done()
+		return
+	default:
+	}
+
+	go func() {
+		estimatedBytes := estimateBatchBytes(batch)
+		if !r.sched.Acquire(r.ctx, estimatedBytes) {
+			r.pending.Done()
+			return
+		}
+		metrics.SetQueueDepth("fetch", r.sched.InFlight())
+
+		start := time.Now()
+		successes, retryErr, permErrs := attemptBatch(batch, attempt)
+		r.sched.Release(estimatedBytes, scheduler.Outcome{
+			Latency:     time.Since(start),
+			RateLimited: retryErr != nil,
+		})
+		metrics.SetQueueDepth("fetch", r.sched.InFlight())
+
+		for _, result := range successes {
+			checkpoint(r.ctx, r.backend, result)
+			r.results <- result
+		}
+
+		for _, err := range permErrs {
+			atomic.AddInt32(&r.failures, 1)
+			r.errs <- err
+		}
+
+		// NOTE: attemptBatch doesn't take a ctx, so this goroutine can still
+		// be past the ctx.Done() check at the top of schedule and mid-HTTP
+		// request when SIGINT arrives. By the time it gets here, r.retries.run
+		// has already drained the heap and returned, so pushing a retry now
+		// would sit in an empty queue nobody is reading, and pending.Wait
+		// would hang forever. Give up instead of deferring once ctx is done.
+		if retryErr != nil && attempt+1 < MaxAttempts && r.ctx.Err() == nil {
+			r.defer_(batch, attempt, retryErr)
+			return
+		}
+
+		if retryErr != nil {
+			atomic.AddInt32(&r.failures, 1)
+			r.errs <- fmt.Errorf("giving up on batch after %d attempts: %w", attempt+1, retryErr)
+		}
+
+		r.pending.Done()
+	}()
+}
+
+// estimateBatchBytes approximates the in-flight response size for batch so
+// the scheduler can weigh it against the memory cap without needing an
+// exact Content-Length.
+func estimateBatchBytes(batch npm.Batch) int64 {
+	return int64(len(batch.Packages)) * int64(estimatePeriodDays(batch.Period)) * BytesPerDayEntryEstimate
+}
+
+func estimatePeriodDays(period string) int {
+	switch period {
+	case "last-day":
+		return 1
+	case "last-week":
+		return 7
+	case "last-month":
+		return 30
+	case "last-year":
+		return 365
+	}
+
+	if start, end, ok := strings.Cut(period, ":"); ok {
+		if from, err := time.Parse(DateFormat, start); err == nil {
+			if to, err := time.Parse(DateFormat, end); err == nil {
+				days := int(to.Sub(from).Hours()/24) + 1
+				if days > 0 {
+					return days
+				}
+			}
+		}
+	}
+
+	return 30 // NOTE: reasonable default for a single explicit day or an unrecognized form.
+}
+
+func (r *runner) defer_(batch npm.Batch, attempt int, cause error) {
+	delay := backoff(attempt, retryAfter(cause))
+	at := time.Now().Add(delay)
+
+	for _, pkg := range batch.Packages {
+		cursor, _, _ := r.backend.GetCursor(r.ctx, pkg)
+		cursor.Package = pkg
+		cursor.LastAttemptAt = time.Now()
+		cursor.NextRetryAt = at
+		cursor.ConsecutiveFailures++
+		if err := r.backend.SetCursor(r.ctx, cursor); err != nil {
+			fmt.Printf("SYNC error saving cursor for %v: %v\n", pkg, err)
+		}
+	}
+
+	fmt.Printf(
+		"SYNC defer batch %v until %v (attempt %d): %v\n",
+		batch.Packages, at.Format(time.RFC3339), attempt+1, cause,
+	)
+	r.retries.push(batch, attempt+1, at)
+}
+
+// attemptBatch runs a single fetch attempt for batch and sorts the outcome
+// into the packages that succeeded, a single retryable cause if the batch
+// as a whole hit a rate limit or server error, and any per-package errors
+// (e.g. "package not found") that will never succeed on retry.
+func attemptBatch(batch npm.Batch, attempt int) (successes []npm.SinglePackageResponse, retryErr error, permErrs []error) {
+	localResults := make(chan npm.SinglePackageResponse, len(batch.Packages))
+	localErrs := make(chan error, len(batch.Packages))
+
+	npm.FetchBatch(localResults, localErrs, batch, attempt)
+	close(localResults)
+	close(localErrs)
+
+	for result := range localResults {
+		successes = append(successes, result)
+	}
+
+	for err := range localErrs {
+		var statusErr *_http.StatusError
+		if errors.As(err, &statusErr) && retryableStatus(statusErr.StatusCode) {
+			retryErr = err
+		} else {
+			permErrs = append(permErrs, err)
+		}
+	}
+
+	return
+}
+
+func retryableStatus(code int) bool {
+	return code == 429 || code >= 500
+}
+
+func retryAfter(err error) time.Duration {
+	var statusErr *_http.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// backoff returns how long to wait before the next attempt: the server's
+// Retry-After when it gave one, otherwise full-jitter exponential backoff.
+func backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	delay := BaseBackoff << attempt
+	if delay <= 0 || delay > MaxBackoff { // NOTE: guard against shift overflow.
+		delay = MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// checkpoint records the latest successfully fetched day for result.Package
+// so that a --resume run knows not to re-fetch it.
+func checkpoint(ctx context.Context, backend storage.Backend, result npm.SinglePackageResponse) {
+	if len(result.Downloads) == 0 {
+		return
+	}
+
+	last := result.Downloads[0].Day
+	for _, point := range result.Downloads[1:] {
+		if point.Day > last { // NOTE: YYYY-MM-DD sorts lexicographically.
+			last = point.Day
+		}
+	}
+
+	cursor, _, _ := backend.GetCursor(ctx, result.Package)
+	cursor.Package = result.Package
+	cursor.LastSuccessfulDay = last
+	cursor.LastAttemptAt = time.Now()
+	cursor.NextRetryAt = time.Time{}
+	cursor.ConsecutiveFailures = 0
+
+	if err := backend.SetCursor(ctx, cursor); err != nil {
+		fmt.Printf("SYNC error saving cursor for %v: %v\n", result.Package, err)
+	}
+}
@@ -0,0 +1,93 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeWindow(t *testing.T) {
+	today := time.Now().Format(DateFormat)
+
+	cases := []struct {
+		name              string
+		lastSuccessfulDay string
+		wantHasWork       bool
+	}{
+		{
+			name:              "yesterday leaves work to do",
+			lastSuccessfulDay: time.Now().AddDate(0, 0, -1).Format(DateFormat),
+			wantHasWork:       true,
+		},
+		{
+			name:              "today is already up to date",
+			lastSuccessfulDay: today,
+			wantHasWork:       false,
+		},
+		{
+			name:              "a future day is already up to date",
+			lastSuccessfulDay: time.Now().AddDate(0, 0, 1).Format(DateFormat),
+			wantHasWork:       false,
+		},
+		{
+			name:              "unparseable day has no work",
+			lastSuccessfulDay: "not-a-date",
+			wantHasWork:       false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			window, hasWork := resumeWindow(c.lastSuccessfulDay)
+			if hasWork != c.wantHasWork {
+				t.Fatalf("hasWork = %v, want %v", hasWork, c.wantHasWork)
+			}
+			if hasWork {
+				start, end, ok := strings.Cut(window, ":")
+				if !ok {
+					t.Fatalf("window %q is not a start:end period", window)
+				}
+
+				last, _ := time.Parse(DateFormat, c.lastSuccessfulDay)
+				if wantStart := last.AddDate(0, 0, 1).Format(DateFormat); start != wantStart {
+					t.Errorf("window start = %q, want %q", start, wantStart)
+				}
+				if end != today {
+					t.Errorf("window end = %q, want %q", end, today)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffUsesRetryAfterWhenPresent(t *testing.T) {
+	got := backoff(0, 30*time.Second)
+	if got != 30*time.Second {
+		t.Fatalf("backoff with a Retry-After = %v, want 30s", got)
+	}
+}
+
+func TestBackoffIsJitteredWithinExponentialBound(t *testing.T) {
+	for attempt := 0; attempt < 6; attempt++ {
+		bound := BaseBackoff << attempt
+		if bound <= 0 || bound > MaxBackoff {
+			bound = MaxBackoff
+		}
+
+		for i := 0; i < 20; i++ {
+			got := backoff(attempt, 0)
+			if got < 0 || got >= bound {
+				t.Fatalf("attempt %d: backoff() = %v, want in [0, %v)", attempt, got, bound)
+			}
+		}
+	}
+}
+
+func TestBackoffNeverExceedsMaxBackoff(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		got := backoff(62, 0) // NOTE: large enough attempt to overflow BaseBackoff<<attempt.
+		if got < 0 || got >= MaxBackoff {
+			t.Fatalf("backoff(62, 0) = %v, want in [0, %v)", got, MaxBackoff)
+		}
+	}
+}
@@ -1,36 +1,32 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"os/signal"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/make-github-pseudonymous-again/npm-downloads/internals/dependencies"
+	"github.com/schollz/progressbar/v3"
+
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/metrics"
 	"github.com/make-github-pseudonymous-again/npm-downloads/internals/npm"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/scheduler"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/storage"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/storage/postgres"
+	"github.com/make-github-pseudonymous-again/npm-downloads/internals/storage/sqlite"
+	_sync "github.com/make-github-pseudonymous-again/npm-downloads/internals/sync"
 )
 
 const (
-	DownloadsUpsertTemplate = `
-	INSERT INTO downloads (
-		name, count, date, last_updated_at,
-		date_year, date_month, date_day, date_day_of_week
-	) VALUES %s
-	ON CONFLICT(name, date_year, date_month, date_day)
-	DO UPDATE SET
-		count=excluded.count,
-		last_updated_at=excluded.last_updated_at
-	WHERE
-		excluded.count > downloads.count;
-	`
-
 	DateFormat = "2006-01-02"
-	// TODO: https://api.npmjs.org/versions/{url-encoded-/ package name}/last-week
-	// NOTE: https://github.com/npm/registry/blob/main/docs/download-counts.md#per-version-download-counts
 
 	// NOTE: Can also have the form YYYY-MM-DD or YYYY-MM-DD:YYYY-MM-DD
 	LastDay   = "last-day"
@@ -58,14 +54,21 @@ func (values *Values) Set(value string) error {
 }
 
 type Args struct {
-	Batch       int
-	Queue       int
-	Period      string
-	Authors     []string
-	Scopes      []string
-	Maintainers []string
-	Keywords    []string
-	Packages    []string
+	Batch          int
+	ConcurrencyMin int
+	ConcurrencyMax int
+	MemoryCapMB    int64
+	Period         string
+	Resume         bool
+	Storage        string
+	MetricsAddr    string
+	PerVersion     bool
+	NoProgress     bool
+	Authors        []string
+	Scopes         []string
+	Maintainers    []string
+	Keywords       []string
+	Packages       []string
 }
 
 func _args() Args {
@@ -79,12 +82,26 @@ func _args() Args {
 	flag.Var(&maintainers, "maintainer", "Maintainer queries")
 	flag.Var(&keywords, "keyword", "Keyword queries")
 	batch := flag.Int("batch", 100, "Batch size for DB inserts")
-	queue := flag.Int("queue", 2, "Queue size for API fetches")
+	concurrencyMin := flag.Int("concurrency-min", 1, "Minimum concurrent API fetches/searches")
+	concurrencyMax := flag.Int("concurrency-max", 32, "Maximum concurrent API fetches/searches")
+	memoryCapMB := flag.Int64("memory-cap", 64, "Memory budget in MB for in-flight fetch responses")
+	resume := flag.Bool("resume", false, "Resume from the last checkpoint instead of refetching --period in full")
+	storageURL := flag.String("storage", "sqlite3://./storage.sqlite3", "Storage backend: sqlite3://<path> or postgres://<dsn>")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus /metrics on (disabled if empty)")
+	perVersion := flag.Bool("per-version", false, "Also fetch per-version download counts (last-week only) after the aggregate fetch")
+	noProgress := flag.Bool("no-progress", false, "Disable progress bars (useful in CI, where they just add noise to logs)")
 	flag.Parse()
 	packages := flag.Args()
 	fmt.Printf("Batch: %v\n", *batch)
-	fmt.Printf("Queue: %v\n", *queue)
+	fmt.Printf("ConcurrencyMin: %v\n", *concurrencyMin)
+	fmt.Printf("ConcurrencyMax: %v\n", *concurrencyMax)
+	fmt.Printf("MemoryCapMB: %v\n", *memoryCapMB)
 	fmt.Printf("Period: %v\n", *period)
+	fmt.Printf("Resume: %v\n", *resume)
+	fmt.Printf("Storage: %v\n", *storageURL)
+	fmt.Printf("MetricsAddr: %v\n", *metricsAddr)
+	fmt.Printf("PerVersion: %v\n", *perVersion)
+	fmt.Printf("NoProgress: %v\n", *noProgress)
 	fmt.Printf("Authors: %v\n", authors)
 	fmt.Printf("Scopes: %v\n", scopes)
 	fmt.Printf("Maintainers: %v\n", maintainers)
@@ -92,8 +109,15 @@ func _args() Args {
 	fmt.Printf("Packages: %v\n", packages)
 	return Args{
 		*batch,
-		*queue,
+		*concurrencyMin,
+		*concurrencyMax,
+		*memoryCapMB,
 		*period,
+		*resume,
+		*storageURL,
+		*metricsAddr,
+		*perVersion,
+		*noProgress,
 		authors,
 		scopes,
 		maintainers,
@@ -102,14 +126,110 @@ func _args() Args {
 	}
 }
 
-func main() {
-	db := dependencies.Storage()
-	defer db.Close()
+// newBar builds a progress bar for description, or nil if progress bars are
+// disabled; every call site below treats a nil bar as a no-op. max of -1
+// renders an indeterminate spinner instead of a percentage.
+func newBar(enabled bool, max int64, description string) *progressbar.ProgressBar {
+	if !enabled {
+		return nil
+	}
+	return progressbar.NewOptions64(
+		max,
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionClearOnFinish(),
+	)
+}
+
+func barAdd(bar *progressbar.ProgressBar, n int) {
+	if bar != nil {
+		bar.Add(n)
+	}
+}
 
+func barSetMax(bar *progressbar.ProgressBar, max int64) {
+	if bar != nil {
+		bar.ChangeMax64(max)
+	}
+}
+
+func barFinish(bar *progressbar.ProgressBar) {
+	if bar != nil {
+		bar.Finish()
+	}
+}
+
+// openBackend dispatches url's scheme (sqlite3:// or postgres://) to the
+// matching storage.Backend driver.
+func openBackend(url string) (storage.Backend, error) {
+	scheme, rest, ok := strings.Cut(url, "://")
+	if !ok {
+		return nil, fmt.Errorf("storage: %q is missing a scheme (expected sqlite3://... or postgres://...)", url)
+	}
+
+	switch scheme {
+	case "sqlite3":
+		// NOTE: mattn/go-sqlite3 wants a bare path, not a sqlite3:// URL.
+		return sqlite.Open(rest)
+	case "postgres":
+		// NOTE: lib/pq only runs its URL parser when the string still
+		// starts with postgres://, so pass the original url through rather
+		// than the scheme-stripped rest.
+		return postgres.Open(url)
+	default:
+		return nil, fmt.Errorf("storage: unknown scheme %q", scheme)
+	}
+}
+
+func main() {
 	args := _args()
 
+	backend, err := openBackend(args.Storage)
+	if err != nil {
+		log.Fatalf("Error opening storage backend: %v\n", err)
+	}
+	defer backend.Close()
+
+	if args.MetricsAddr != "" {
+		metrics.Serve(args.MetricsAddr)
+	}
+
+	var packagesFetched, rowsInserted int64
+	failures := 0
+
+	// ctx is installed before any scheduler work starts (search included)
+	// so a SIGINT during a long search phase is caught too, not just
+	// during fetch/insert.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT)
+	defer stop()
+
+	// searchBar, fetchBar and insertBar are filled in as each phase starts;
+	// the interrupt handler below closes over them by reference so it can
+	// finish whichever bars exist yet at the time of a SIGINT.
+	var searchBar, fetchBar, insertBar *progressbar.ProgressBar
+
+	go func() {
+		<-ctx.Done()
+		if !args.NoProgress {
+			barFinish(searchBar)
+			barFinish(fetchBar)
+			barFinish(insertBar)
+		}
+		fmt.Printf(
+			"Interrupted: %d packages fetched, %d rows inserted, %d failures so far\n",
+			atomic.LoadInt64(&packagesFetched), atomic.LoadInt64(&rowsInserted), failures,
+		)
+	}()
+
+	searchScheduler := scheduler.New(scheduler.Config{
+		Min: args.ConcurrencyMin,
+		Max: args.ConcurrencyMax,
+	})
+
+	// searchBar is indeterminate: a query's pagination can run for an
+	// unknown number of pages, so there's no total to track against.
+	searchBar = newBar(!args.NoProgress, -1, "search")
+
 	var searchWaitGroup sync.WaitGroup
-	searchQueue := make(chan struct{}, args.Queue)
 	searchResults := make(chan npm.SearchResponseObject)
 	searchErrors := make(chan error)
 
@@ -130,7 +250,7 @@ func main() {
 		query := fmt.Sprintf("keyword:%s", keyword)
 		queries = append(queries, query)
 	}
-	scheduleSearches(&searchWaitGroup, searchQueue, searchResults, searchErrors, queries)
+	scheduleSearches(ctx, &searchWaitGroup, searchScheduler, searchResults, searchErrors, queries)
 
 	var packages []string
 
@@ -141,6 +261,7 @@ func main() {
 				if ok {
 					log.Printf("Found: %v\n", result.Package.Name)
 					packages = append(packages, result.Package.Name)
+					barAdd(searchBar, 1)
 				} else {
 					searchResults = nil
 				}
@@ -154,6 +275,7 @@ func main() {
 
 	fmt.Println("WAIT search")
 	searchWaitGroup.Wait()
+	barFinish(searchBar)
 	fmt.Println("DONE search")
 
 	for _, pkg := range args.Packages {
@@ -163,23 +285,35 @@ func main() {
 	slices.Sort(packages)
 	slices.Compact(packages)
 
-	var fetchWaitGroup sync.WaitGroup
-	fetchQueue := make(chan struct{}, args.Queue)
+	fetchScheduler := scheduler.New(scheduler.Config{
+		Min:            args.ConcurrencyMin,
+		Max:            args.ConcurrencyMax,
+		MemoryCapBytes: args.MemoryCapMB * 1024 * 1024,
+	})
+
 	fetchResults := make(chan npm.SinglePackageResponse)
 	fetchErrors := make(chan error)
 
 	requestTime := time.Now()
-	batches := npm.PackageDownloadBatches(args.Period, packages)
-	scheduleFetches(&fetchWaitGroup, fetchQueue, fetchResults, fetchErrors, batches)
+
+	// fetchBar counts per-package deliveries on fetchResults/fetchErrors, not
+	// batches, since FetchBatchMany delivers one result or error per package
+	// in the batch. The total is an estimate: --resume can drop
+	// already-synced packages from what actually gets fetched, and a batch
+	// whose whole request fails delivers a single error for all its packages.
+	fetchBar = newBar(!args.NoProgress, int64(len(packages)), "fetch")
+	var insertTotal int64
+	insertBar = newBar(!args.NoProgress, 0, "insert")
 
 	var insertWaitGroup sync.WaitGroup
-	// NOTE: We only allow one insert at a time since there is no possible
-	// concurrency with sqlite3 and the pre-processing is quite light.
-	insertQueue := make(chan struct{}, 1)
+	// NOTE: Sized from the backend itself: sqlite3 only tolerates one writer,
+	// while postgres can take several concurrent upserts. Its observed
+	// throughput still feeds back into fetchScheduler below, so a struggling
+	// insert side throttles fetch concurrency rather than piling up
+	// unconsumed results.
+	insertQueue := make(chan struct{}, backend.MaxConcurrentWrites())
 	insertErrors := make(chan error)
 
-	failures := 0
-
 	var insertLoopWaitGroup sync.WaitGroup
 	insertLoopWaitGroup.Add(2)
 	go func() {
@@ -188,14 +322,21 @@ func main() {
 			select {
 			case result, ok := <-fetchResults:
 				if ok {
+					barAdd(fetchBar, 1)
+					atomic.AddInt64(&packagesFetched, 1)
+					insertTotal += int64(len(result.Downloads))
+					barSetMax(insertBar, insertTotal)
 					scheduleInserts(
 						&insertWaitGroup,
 						insertQueue,
 						insertErrors,
-						db,
+						fetchScheduler,
+						backend,
 						args.Batch,
 						result,
 						requestTime,
+						insertBar,
+						&rowsInserted,
 					)
 				} else {
 					fetchResults = nil
@@ -214,8 +355,10 @@ func main() {
 			select {
 			case err, ok := <-fetchErrors:
 				if ok {
-					log.Printf("Error occurred during fetch: %v\n", err)
+					slog.Warn("fetch error", "error", err)
+					metrics.IncFailure("fetch")
 					failures += 1
+					barAdd(fetchBar, 1)
 				} else {
 					fetchErrors = nil
 				}
@@ -235,7 +378,8 @@ func main() {
 			select {
 			case err, ok := <-insertErrors:
 				if ok {
-					log.Printf("Error occurred during insert: %v\n", err)
+					slog.Warn("insert error", "error", err)
+					metrics.IncFailure("insert")
 					failures += 1
 				} else {
 					insertErrors = nil
@@ -249,75 +393,129 @@ func main() {
 	}()
 
 	fmt.Println("WAIT fetch")
-	fetchWaitGroup.Wait()
+	syncResult := _sync.Run(ctx, _sync.Config{
+		Backend:   backend,
+		Period:    args.Period,
+		Packages:  packages,
+		Scheduler: fetchScheduler,
+		Resume:    args.Resume,
+	}, fetchResults, fetchErrors)
 	close(fetchResults)
 	close(fetchErrors)
 	fmt.Println("WAIT insert loop")
 	insertLoopWaitGroup.Wait()
+	barFinish(fetchBar)
 	fmt.Println("WAIT insert")
 	insertWaitGroup.Wait()
+
+	if args.PerVersion {
+		fmt.Println("WAIT version fetch+insert")
+		failures += fetchVersionDownloads(
+			ctx, fetchScheduler, insertQueue, insertErrors, backend, args.Batch, packages, requestTime,
+			insertBar, &insertTotal, &rowsInserted,
+		)
+	}
+
+	barFinish(insertBar)
 	close(insertQueue)
 	close(insertErrors)
 	fmt.Println("WAIT insert loop errors")
 	insertLoopErrorsWaitGroup.Wait()
+	failures += syncResult.Failures
 	fmt.Printf("Failures: %v\n", failures)
 	fmt.Println("DONE")
 }
 
-func createBatchArgs(requestTime time.Time, name string, batch []npm.DailyDownload) ([]string, []interface{}) {
-	var placeholders []string
-	var args []interface{}
+// fetchVersionDownloads runs the optional --per-version phase: one
+// per-version fetch per package through the same fetchScheduler used for
+// aggregate downloads, upserting results through the same insertQueue.
+// It returns the number of per-version fetch failures observed; insert
+// failures are reported on insertErrors instead.
+func fetchVersionDownloads(
+	ctx context.Context,
+	sched *scheduler.Scheduler,
+	insertQueue chan struct{},
+	insertErrors chan<- error,
+	backend storage.Backend,
+	batchSize int,
+	packages []string,
+	requestTime time.Time,
+	insertBar *progressbar.ProgressBar,
+	insertTotal *int64,
+	rowsInserted *int64,
+) int {
+	batches := npm.VersionDownloadBatches(LastWeek, packages)
 
-	for k, point := range batch {
-		date, err := time.Parse(DateFormat, point.Day)
-		if err != nil {
-			log.Printf("Error parsing date: %v\n", err)
-		}
-		year := date.Year()
-		month := int(date.Month())
-		day := date.Day()
-		dayOfWeek := int(date.Weekday())
-
-		fmt.Printf("BATCH add record for %v (%v, %v)\n", name, point.Day, point.Downloads)
-
-		placeholders = append(
-			placeholders,
-			fmt.Sprintf(
-				// NOTE: ($1, $2, $3, $4, ...)
-				"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
-				k*8+1, k*8+2, k*8+3, k*8+4, k*8+5, k*8+6, k*8+7, k*8+8,
-			),
-		)
+	versionResults := make(chan npm.PackageVersionDownloads)
+	versionErrors := make(chan error)
 
-		// Append the actual values to the args slice
-		args = append(args,
-			name,            // $1: name
-			point.Downloads, // $2: count
-			date,            // $3: date
-			requestTime,     // $4: last_updated_at
-			year,            // $5: date_year
-			month,           // $6: date_month
-			day,             // $7: date_day
-			dayOfWeek,       // $8: date_day_of_week
-		)
+	var fetchWaitGroup sync.WaitGroup
+	for _, batch := range batches {
+		fetchWaitGroup.Add(1)
+		go func(batch npm.Batch) {
+			defer fetchWaitGroup.Done()
+			if !sched.Acquire(ctx, 0) {
+				return
+			}
+			metrics.SetQueueDepth("fetch", sched.InFlight())
+			start := time.Now()
+			defer func() {
+				sched.Release(0, scheduler.Outcome{Latency: time.Since(start)})
+				metrics.SetQueueDepth("fetch", sched.InFlight())
+			}()
+
+			npm.FetchVersionDownloads(versionResults, versionErrors, batch.Packages[0], batch.Period)
+		}(batch)
 	}
 
-	return placeholders, args
+	var insertWaitGroup sync.WaitGroup
+	failures := 0
+
+	var collectWaitGroup sync.WaitGroup
+	collectWaitGroup.Add(2)
+	go func() {
+		defer collectWaitGroup.Done()
+		for result := range versionResults {
+			*insertTotal += int64(len(result.Versions))
+			barSetMax(insertBar, *insertTotal)
+			scheduleVersionInserts(&insertWaitGroup, insertQueue, insertErrors, backend, batchSize, result, requestTime, insertBar, rowsInserted)
+		}
+	}()
+	go func() {
+		defer collectWaitGroup.Done()
+		for err := range versionErrors {
+			slog.Warn("version fetch error", "error", err)
+			metrics.IncFailure("version-fetch")
+			failures++
+		}
+	}()
+
+	fetchWaitGroup.Wait()
+	close(versionResults)
+	close(versionErrors)
+	collectWaitGroup.Wait()
+	insertWaitGroup.Wait()
+
+	return failures
 }
 
-func scheduleInserts(
+func scheduleVersionInserts(
 	wg *sync.WaitGroup,
 	queue chan struct{},
 	errors chan<- error,
-	db *sql.DB,
+	backend storage.Backend,
 	batchSize int,
-	pkg npm.SinglePackageResponse,
+	result npm.PackageVersionDownloads,
 	requestTime time.Time,
+	insertBar *progressbar.ProgressBar,
+	rowsInserted *int64,
 ) {
-	fmt.Printf("INSERT schedule %v\n", pkg.Package)
+	slog.Info("insert version schedule", "package", result.Package, "versions", len(result.Versions))
 
-	for i := 0; i < len(pkg.Downloads); i += batchSize {
-		j := min(i+batchSize, len(pkg.Downloads))
+	periodEnd := requestTime.Format(DateFormat)
+
+	for i := 0; i < len(result.Versions); i += batchSize {
+		j := min(i+batchSize, len(result.Versions))
 
 		wg.Add(1)
 		go func(i int, j int) {
@@ -325,52 +523,82 @@ func scheduleInserts(
 			queue <- struct{}{}        // NOTE: Acquire worker slot.
 			defer func() { <-queue }() // NOTE: Release worker slot.
 
-			batch := pkg.Downloads[i:j]
-
-			placeholders, args := createBatchArgs(requestTime, pkg.Package, batch)
-
-			query := fmt.Sprintf(
-				DownloadsUpsertTemplate,
-				strings.Join(placeholders, ","),
-			)
-
-			fmt.Printf("BATCH execute (%v)\n", j-i)
+			batch := result.Versions[i:j]
+			downloads := make([]storage.VersionDownload, len(batch))
+			for k, v := range batch {
+				downloads[k] = storage.VersionDownload{Version: v.Version, Downloads: v.Downloads}
+			}
 
-			_, err := db.Exec(query, args...)
-			if err != nil {
-				errors <- fmt.Errorf("error executing batch insert query: %v", err)
+			if err := backend.UpsertVersionDownloads(context.Background(), result.Package, periodEnd, downloads, requestTime); err != nil {
+				errors <- fmt.Errorf("error executing version batch insert query: %v", err)
+				return
 			}
-		}(i, j)
 
+			barAdd(insertBar, j-i)
+			atomic.AddInt64(rowsInserted, int64(j-i))
+		}(i, j)
 	}
 }
 
-func scheduleFetches(
+func scheduleInserts(
 	wg *sync.WaitGroup,
 	queue chan struct{},
-	results chan<- npm.SinglePackageResponse,
 	errors chan<- error,
-	batches []npm.Batch,
+	sched *scheduler.Scheduler,
+	backend storage.Backend,
+	batchSize int,
+	pkg npm.SinglePackageResponse,
+	requestTime time.Time,
+	insertBar *progressbar.ProgressBar,
+	rowsInserted *int64,
 ) {
-	for _, batch := range batches {
+	slog.Info("insert schedule", "package", pkg.Package, "rows", len(pkg.Downloads))
+
+	for i := 0; i < len(pkg.Downloads); i += batchSize {
+		j := min(i+batchSize, len(pkg.Downloads))
+
 		wg.Add(1)
-		go func(batch npm.Batch) {
+		go func(i int, j int) {
 			defer wg.Done()
-			queue <- struct{}{}        // NOTE: Acquire worker slot.
-			defer func() { <-queue }() // NOTE: Release worker slot.
+			queue <- struct{}{} // NOTE: Acquire worker slot.
+			metrics.SetQueueDepth("insert", len(queue))
+			defer func() {
+				<-queue // NOTE: Release worker slot.
+				metrics.SetQueueDepth("insert", len(queue))
+			}()
+
+			batch := pkg.Downloads[i:j]
+
+			downloads := make([]storage.DailyDownload, len(batch))
+			for k, point := range batch {
+				downloads[k] = storage.DailyDownload{Day: point.Day, Downloads: point.Downloads}
+			}
+
+			slog.Info("insert batch", "package", pkg.Package, "rows", j-i)
+
+			start := time.Now()
+			if err := backend.UpsertDownloads(context.Background(), pkg.Package, downloads, requestTime); err != nil {
+				errors <- fmt.Errorf("error executing batch insert query: %v", err)
+				return
+			}
+
+			elapsed := time.Since(start)
+			metrics.ObserveInsert(elapsed, j-i)
+			if elapsed > 0 {
+				sched.ReportInsertThroughput(float64(j-i) / elapsed.Seconds())
+			}
+
+			barAdd(insertBar, j-i)
+			atomic.AddInt64(rowsInserted, int64(j-i))
+		}(i, j)
 
-			npm.FetchBatch(
-				results,
-				errors,
-				batch,
-			)
-		}(batch)
 	}
 }
 
 func scheduleSearches(
+	ctx context.Context,
 	wg *sync.WaitGroup,
-	queue chan struct{},
+	sched *scheduler.Scheduler,
 	results chan<- npm.SearchResponseObject,
 	errors chan<- error,
 	queries []string,
@@ -379,8 +607,15 @@ func scheduleSearches(
 		wg.Add(1)
 		go func(query string) {
 			defer wg.Done()
-			queue <- struct{}{}        // NOTE: Acquire worker slot.
-			defer func() { <-queue }() // NOTE: Release worker slot.
+			if !sched.Acquire(ctx, 0) {
+				return
+			}
+			metrics.SetQueueDepth("search", sched.InFlight())
+			start := time.Now()
+			defer func() {
+				sched.Release(0, scheduler.Outcome{Latency: time.Since(start)})
+				metrics.SetQueueDepth("search", sched.InFlight())
+			}()
 
 			npm.Search(
 				results,